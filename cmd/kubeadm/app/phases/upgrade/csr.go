@@ -0,0 +1,108 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package upgrade
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	certutil "k8s.io/client-go/util/cert"
+)
+
+// csrSummary is the JSON sidecar written next to a CSR, so an operator's cert-manager or
+// Vault pipeline can tell at a glance what it's being asked to sign and why, without
+// having to parse the CSR's ASN.1 itself.
+type csrSummary struct {
+	CertName    string    `json:"certName"`
+	CommonName  string    `json:"commonName"`
+	DNSNames    []string  `json:"dnsNames,omitempty"`
+	IPAddresses []string  `json:"ipAddresses,omitempty"`
+	NotAfter    time.Time `json:"currentCertNotAfter"`
+	CSRPath     string    `json:"csrPath"`
+}
+
+// writeCSRForExternalCA writes a PKCS#10 CSR for spec's certificate, reusing the CN and
+// SANs of the certificate currently on disk and signing the request with that
+// certificate's existing private key, next to a JSON summary describing what's being
+// requested. It's used in place of regenerating a certificate in-place when the CA that
+// issued it is external to kubeadm (kubeadm only has the CA's certificate, not its key).
+func writeCSRForExternalCA(certAndKeyDir string, spec certRenewSpec) (string, error) {
+	certPath := filepath.Join(certAndKeyDir, spec.certName)
+	keyPath := filepath.Join(certAndKeyDir, spec.keyName)
+
+	certs, err := certutil.CertsFromFile(certPath)
+	if err != nil {
+		return "", fmt.Errorf("couldn't load the certificate file %s: %v", certPath, err)
+	}
+
+	key, err := certutil.PrivateKeyFromFile(keyPath)
+	if err != nil {
+		return "", fmt.Errorf("couldn't load the private key file %s: %v", keyPath, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return "", fmt.Errorf("private key %s doesn't support signing a CSR", keyPath)
+	}
+
+	cert := certs[0]
+	template := &x509.CertificateRequest{
+		Subject:     cert.Subject,
+		DNSNames:    cert.DNSNames,
+		IPAddresses: cert.IPAddresses,
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, template, signer)
+	if err != nil {
+		return "", fmt.Errorf("couldn't create a CSR for %s: %v", spec.certName, err)
+	}
+
+	base := strings.TrimSuffix(spec.certName, filepath.Ext(spec.certName))
+	csrPath := filepath.Join(certAndKeyDir, base+".csr")
+	csrPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER})
+	if err := ioutil.WriteFile(csrPath, csrPEM, 0644); err != nil {
+		return "", fmt.Errorf("couldn't write CSR file %s: %v", csrPath, err)
+	}
+
+	ips := make([]string, 0, len(cert.IPAddresses))
+	for _, ip := range cert.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	summary := csrSummary{
+		CertName:    spec.certName,
+		CommonName:  cert.Subject.CommonName,
+		DNSNames:    cert.DNSNames,
+		IPAddresses: ips,
+		NotAfter:    cert.NotAfter,
+		CSRPath:     csrPath,
+	}
+	summaryJSON, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("couldn't marshal CSR summary for %s: %v", spec.certName, err)
+	}
+	if err := ioutil.WriteFile(csrPath+".json", summaryJSON, 0644); err != nil {
+		return "", fmt.Errorf("couldn't write CSR summary file %s.json: %v", csrPath, err)
+	}
+
+	return csrPath, nil
+}
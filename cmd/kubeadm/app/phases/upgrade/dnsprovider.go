@@ -0,0 +1,148 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package upgrade
+
+import (
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	kubeadmapi "k8s.io/kubernetes/cmd/kubeadm/app/apis/kubeadm"
+	kubeadmconstants "k8s.io/kubernetes/cmd/kubeadm/app/constants"
+	"k8s.io/kubernetes/cmd/kubeadm/app/features"
+	"k8s.io/kubernetes/cmd/kubeadm/app/phases/addons/dns"
+	"k8s.io/kubernetes/cmd/kubeadm/app/util/apiclient"
+)
+
+// DNSProvider is one in-cluster DNS installation kubeadm can install or remove during an
+// upgrade. Out-of-tree providers (NodeLocal DNSCache, a custom CoreDNS fork, an
+// operator-managed Deployment) implement this and call RegisterDNSProvider from an init
+// func in their own package, so kubeadm never has to know about them ahead of time.
+type DNSProvider interface {
+	// Name is the value resolvedDNSType would need to return to select this provider. It
+	// only ever matches kube-dns or CoreDNS today, since MasterConfiguration has no field
+	// yet letting an operator name an out-of-tree provider directly; see resolvedDNSType.
+	Name() string
+	// Detect reports whether this provider's Deployment is present and ready in client.
+	Detect(client clientset.Interface) (bool, error)
+	// Ensure installs or updates this provider against cfg and client.
+	Ensure(cfg *kubeadmapi.MasterConfiguration, client clientset.Interface) error
+	// Remove deletes this provider's Deployment. It must tolerate the Deployment already
+	// being gone.
+	Remove(client clientset.Interface) error
+}
+
+// replaceableDNSProvider is implemented by providers willing to be removed automatically
+// once another provider has taken over as the cluster's DNS. Providers that don't
+// implement it are left alone even once they're no longer the configured provider, so an
+// upgrade never silently deletes a DNS Deployment kubeadm doesn't understand just because
+// resolvedDNSType(cfg) changed.
+type replaceableDNSProvider interface {
+	DNSProvider
+	ReplaceableByAnother() bool
+}
+
+var dnsProviders = map[string]DNSProvider{}
+
+// RegisterDNSProvider adds provider to the registry EnsureDNSProvider and the old-DNS
+// removal step both consult.
+func RegisterDNSProvider(provider DNSProvider) {
+	dnsProviders[provider.Name()] = provider
+}
+
+func init() {
+	RegisterDNSProvider(&deploymentDNSProvider{deployment: kubeadmconstants.KubeDNS})
+	RegisterDNSProvider(&deploymentDNSProvider{deployment: kubeadmconstants.CoreDNS})
+}
+
+// deploymentDNSProvider is the DNSProvider for kube-dns and CoreDNS: both ship as a single
+// Deployment in kube-system, and both still install through the existing
+// dns.EnsureDNSAddon, which already knows how to template and apply either one's
+// manifests based on the CoreDNS feature gate.
+type deploymentDNSProvider struct {
+	deployment string
+}
+
+func (p *deploymentDNSProvider) Name() string { return p.deployment }
+
+func (p *deploymentDNSProvider) Detect(client clientset.Interface) (bool, error) {
+	d, err := client.AppsV1().Deployments(metav1.NamespaceSystem).Get(p.deployment, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return d.Status.ReadyReplicas > 0, nil
+}
+
+func (p *deploymentDNSProvider) Ensure(cfg *kubeadmapi.MasterConfiguration, client clientset.Interface) error {
+	return dns.EnsureDNSAddon(cfg, client)
+}
+
+func (p *deploymentDNSProvider) Remove(client clientset.Interface) error {
+	err := apiclient.DeleteDeploymentForeground(client, metav1.NamespaceSystem, p.deployment)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (p *deploymentDNSProvider) ReplaceableByAnother() bool { return true }
+
+// resolvedDNSType returns the DNS provider cfg currently selects. MasterConfiguration has
+// no field yet for an operator (or an out-of-tree provider) to name a registered provider
+// directly, so this and dns.EnsureDNSAddon, which deploymentDNSProvider.Ensure defers to,
+// both have to make the same kube-dns/CoreDNS choice off the CoreDNS feature gate;
+// otherwise the registry's idea of "current" could disagree with what Ensure actually
+// installed, and dnsRemovalStep would wait forever on a Deployment that was never created.
+//
+// This is the scope this registry ships with today: an out-of-tree provider registered via
+// RegisterDNSProvider can be *detected and, if it opts in via replaceableDNSProvider,
+// removed* once another provider becomes current, but it can never become current itself,
+// since resolvedDNSType can only ever name kube-dns or CoreDNS. Letting an operator actually
+// select it needs a real field on MasterConfiguration, which is an API types change outside
+// this package; until that lands, EnsureDNSProvider only ever installs kube-dns or CoreDNS.
+func resolvedDNSType(cfg *kubeadmapi.MasterConfiguration) string {
+	if features.Enabled(cfg.FeatureGates, features.CoreDNS) {
+		return kubeadmconstants.CoreDNS
+	}
+	return kubeadmconstants.KubeDNS
+}
+
+// EnsureDNSProvider installs the provider selected by resolvedDNSType. Today that's always
+// kube-dns or CoreDNS; see resolvedDNSType for why an out-of-tree provider can't be selected
+// here yet, even though it can be detected and removed elsewhere in this package.
+func EnsureDNSProvider(cfg *kubeadmapi.MasterConfiguration, client clientset.Interface) error {
+	dnsType := resolvedDNSType(cfg)
+	provider, ok := dnsProviders[dnsType]
+	if !ok {
+		return fmt.Errorf("no registered DNS provider for type %q", dnsType)
+	}
+	return provider.Ensure(cfg, client)
+}
+
+// currentDNSProvider returns the registered provider matching resolvedDNSType(cfg).
+func currentDNSProvider(cfg *kubeadmapi.MasterConfiguration) (DNSProvider, error) {
+	dnsType := resolvedDNSType(cfg)
+	provider, ok := dnsProviders[dnsType]
+	if !ok {
+		return nil, fmt.Errorf("no registered DNS provider for type %q", dnsType)
+	}
+	return provider, nil
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package upgrade
+
+import (
+	"fmt"
+	"os"
+)
+
+// FileMover moves files on disk on behalf of the cert backup/renewal code below. It's an
+// interface so dry-run can swap in an implementation that only prints what it would have
+// done, the same way getWaiter swaps in a no-op apiclient.Waiter for dry-run.
+type FileMover interface {
+	// Rename moves the file at from to to.
+	Rename(from, to string) error
+	// MkdirAll creates dir and any missing parents.
+	MkdirAll(dir string) error
+}
+
+// osFileMover is the production FileMover: it really touches the filesystem.
+type osFileMover struct{}
+
+func (osFileMover) Rename(from, to string) error { return os.Rename(from, to) }
+func (osFileMover) MkdirAll(dir string) error    { return os.MkdirAll(dir, 0766) }
+
+// dryRunFileMover is the dry-run FileMover: it logs the rename/mkdir it would have
+// performed, in the same "[dryrun]" style the rest of cmd/kubeadm/app/util/dryrun uses,
+// and leaves the filesystem untouched.
+type dryRunFileMover struct{}
+
+func (dryRunFileMover) Rename(from, to string) error {
+	fmt.Printf("[dryrun] Would move file %q to %q\n", from, to)
+	return nil
+}
+
+func (dryRunFileMover) MkdirAll(dir string) error {
+	fmt.Printf("[dryrun] Would create directory %q\n", dir)
+	return nil
+}
+
+// getFileMover gets the right FileMover implementation for the right occasion.
+func getFileMover(dryRun bool) FileMover {
+	if dryRun {
+		return dryRunFileMover{}
+	}
+	return osFileMover{}
+}
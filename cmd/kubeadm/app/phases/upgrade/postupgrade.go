@@ -20,49 +20,66 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-	"path/filepath"
 	"time"
 
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/errors"
 	clientset "k8s.io/client-go/kubernetes"
-	certutil "k8s.io/client-go/util/cert"
 	kubeadmapi "k8s.io/kubernetes/cmd/kubeadm/app/apis/kubeadm"
 	kubeadmapiv1alpha2 "k8s.io/kubernetes/cmd/kubeadm/app/apis/kubeadm/v1alpha2"
 	kubeadmconstants "k8s.io/kubernetes/cmd/kubeadm/app/constants"
-	"k8s.io/kubernetes/cmd/kubeadm/app/features"
-	"k8s.io/kubernetes/cmd/kubeadm/app/phases/addons/dns"
 	"k8s.io/kubernetes/cmd/kubeadm/app/phases/addons/proxy"
 	"k8s.io/kubernetes/cmd/kubeadm/app/phases/bootstraptoken/clusterinfo"
 	nodebootstraptoken "k8s.io/kubernetes/cmd/kubeadm/app/phases/bootstraptoken/node"
-	certsphase "k8s.io/kubernetes/cmd/kubeadm/app/phases/certs"
 	kubeletphase "k8s.io/kubernetes/cmd/kubeadm/app/phases/kubelet"
 	patchnodephase "k8s.io/kubernetes/cmd/kubeadm/app/phases/patchnode"
-	"k8s.io/kubernetes/cmd/kubeadm/app/phases/selfhosting"
-	"k8s.io/kubernetes/cmd/kubeadm/app/phases/uploadconfig"
 	"k8s.io/kubernetes/cmd/kubeadm/app/util/apiclient"
 	dryrunutil "k8s.io/kubernetes/cmd/kubeadm/app/util/dryrun"
 	"k8s.io/kubernetes/pkg/util/version"
 )
 
-var expiry = 180 * 24 * time.Hour
-
 // PerformPostUpgradeTasks runs nearly the same functions as 'kubeadm init' would do
 // Note that the markmaster phase is left out, not needed, and no token is created as that doesn't belong to the upgrade
+//
+// The steps that aren't safely repeatable (uploading the new configuration, writing the
+// kubelet ComponentConfig ConfigMap, converting to a self-hosted control plane, renewing
+// certificates and swapping the in-cluster DNS Deployment) run through a stepExecutor so
+// that the first hard failure among them rolls every one of them back, leaving the cluster
+// as it was found.
 func PerformPostUpgradeTasks(client clientset.Interface, cfg *kubeadmapi.MasterConfiguration, newK8sVer *version.Version, dryRun bool) error {
+	return performPostUpgradeTasks(client, cfg, newK8sVer, dryRun, false)
+}
+
+// PerformPostUpgradeTasksWithRollbackPolicy is PerformPostUpgradeTasks, but lets the caller
+// opt out of the automatic rollback-on-failure noRollback controls, falling back to
+// best-effort behavior instead: every step is attempted and all errors aggregated. It's a
+// separate function, rather than a parameter added to PerformPostUpgradeTasks itself, so
+// existing callers of that signature keep compiling; wiring a --no-rollback flag through to
+// this from `kubeadm upgrade apply` is still TODO.
+func PerformPostUpgradeTasksWithRollbackPolicy(client clientset.Interface, cfg *kubeadmapi.MasterConfiguration, newK8sVer *version.Version, dryRun, noRollback bool) error {
+	return performPostUpgradeTasks(client, cfg, newK8sVer, dryRun, noRollback)
+}
+
+func performPostUpgradeTasks(client clientset.Interface, cfg *kubeadmapi.MasterConfiguration, newK8sVer *version.Version, dryRun, noRollback bool) error {
 	errs := []error{}
+	executor := &stepExecutor{rollbackOnError: !noRollback}
 
 	// Upload currently used configuration to the cluster
 	// Note: This is done right in the beginning of cluster initialization; as we might want to make other phases
 	// depend on centralized information from this source in the future
-	if err := uploadconfig.UploadConfiguration(cfg, client); err != nil {
+	if err := executor.run(&uploadConfigStep{client: client, cfg: cfg}); err != nil {
 		errs = append(errs, err)
+		if executor.aborted {
+			return errors.NewAggregate(errs)
+		}
 	}
 
 	// Create the new, version-branched kubelet ComponentConfig ConfigMap
-	if err := kubeletphase.CreateConfigMap(cfg, client); err != nil {
-		errs = append(errs, fmt.Errorf("error creating kubelet configuration ConfigMap: %v", err))
+	if err := executor.run(&kubeletConfigMapStep{client: client, cfg: cfg, newK8sVer: newK8sVer}); err != nil {
+		errs = append(errs, err)
+		if executor.aborted {
+			return errors.NewAggregate(errs)
+		}
 	}
 
 	kubeletDir, err := getKubeletDir(dryRun)
@@ -104,8 +121,11 @@ func PerformPostUpgradeTasks(client clientset.Interface, cfg *kubeadmapi.MasterC
 	}
 
 	// Upgrade to a self-hosted control plane if possible
-	if err := upgradeToSelfHosting(client, cfg, dryRun); err != nil {
+	if err := executor.run(&selfHostingStep{client: client, cfg: cfg, dryRun: dryRun}); err != nil {
 		errs = append(errs, err)
+		if executor.aborted {
+			return errors.NewAggregate(errs)
+		}
 	}
 
 	// TODO: Is this needed to do here? I think that updating cluster info should probably be separate from a normal upgrade
@@ -119,29 +139,22 @@ func PerformPostUpgradeTasks(client clientset.Interface, cfg *kubeadmapi.MasterC
 	}
 
 	certAndKeyDir := kubeadmapiv1alpha2.DefaultCertificatesDir
-	shouldBackup, err := shouldBackupAPIServerCertAndKey(certAndKeyDir)
-	// Don't fail the upgrade phase if failing to determine to backup kube-apiserver cert and key.
-	if err != nil {
-		fmt.Printf("[postupgrade] WARNING: failed to determine to backup kube-apiserver cert and key: %v", err)
-	} else if shouldBackup {
-		// TODO: Make sure this works in dry-run mode as well
-		// Don't fail the upgrade phase if failing to backup kube-apiserver cert and key.
-		if err := backupAPIServerCertAndKey(certAndKeyDir); err != nil {
-			fmt.Printf("[postupgrade] WARNING: failed to backup kube-apiserver cert and key: %v", err)
-		}
-		if err := certsphase.CreateAPIServerCertAndKeyFiles(cfg); err != nil {
-			errs = append(errs, err)
+	if err := executor.run(&certRenewalStep{cfg: cfg, certAndKeyDir: certAndKeyDir, dryRun: dryRun}); err != nil {
+		errs = append(errs, err)
+		if executor.aborted {
+			return errors.NewAggregate(errs)
 		}
 	}
 
-	// Upgrade kube-dns/CoreDNS and kube-proxy
-	if err := dns.EnsureDNSAddon(cfg, client); err != nil {
+	// Upgrade the in-cluster DNS provider selected by resolvedDNSType(cfg) and kube-proxy
+	if err := EnsureDNSProvider(cfg, client); err != nil {
 		errs = append(errs, err)
 	}
-	// Remove the old DNS deployment if a new DNS service is now used (kube-dns to CoreDNS or vice versa)
-	if !dryRun { // TODO: Remove dryrun here and make it work
-		if err := removeOldDNSDeploymentIfAnotherDNSIsUsed(cfg, client); err != nil {
-			errs = append(errs, err)
+	// Remove any other registered DNS provider's Deployment that opted in to being replaced
+	if err := executor.run(&dnsRemovalStep{cfg: cfg, client: client, dryRun: dryRun}); err != nil {
+		errs = append(errs, err)
+		if executor.aborted {
+			return errors.NewAggregate(errs)
 		}
 	}
 
@@ -151,44 +164,6 @@ func PerformPostUpgradeTasks(client clientset.Interface, cfg *kubeadmapi.MasterC
 	return errors.NewAggregate(errs)
 }
 
-func removeOldDNSDeploymentIfAnotherDNSIsUsed(cfg *kubeadmapi.MasterConfiguration, client clientset.Interface) error {
-	return apiclient.TryRunCommand(func() error {
-		installedDeploymentName := kubeadmconstants.KubeDNS
-		deploymentToDelete := kubeadmconstants.CoreDNS
-
-		if features.Enabled(cfg.FeatureGates, features.CoreDNS) {
-			installedDeploymentName = kubeadmconstants.CoreDNS
-			deploymentToDelete = kubeadmconstants.KubeDNS
-		}
-		dnsDeployment, err := client.AppsV1().Deployments(metav1.NamespaceSystem).Get(installedDeploymentName, metav1.GetOptions{})
-		if err != nil {
-			return err
-		}
-		if dnsDeployment.Status.ReadyReplicas == 0 {
-			return fmt.Errorf("the DNS deployment isn't ready yet")
-		}
-		err = apiclient.DeleteDeploymentForeground(client, metav1.NamespaceSystem, deploymentToDelete)
-		if err != nil && !apierrors.IsNotFound(err) {
-			return err
-		}
-		return nil
-	}, 10)
-}
-
-func upgradeToSelfHosting(client clientset.Interface, cfg *kubeadmapi.MasterConfiguration, dryRun bool) error {
-	if features.Enabled(cfg.FeatureGates, features.SelfHosting) && !IsControlPlaneSelfHosted(client) {
-
-		waiter := getWaiter(dryRun, client)
-
-		// kubeadm will now convert the static Pod-hosted control plane into a self-hosted one
-		fmt.Println("[self-hosted] Creating self-hosted control plane.")
-		if err := selfhosting.CreateSelfHostedControlPlane(kubeadmconstants.GetStaticPodDirectory(), kubeadmconstants.KubernetesDir, cfg, client, waiter, dryRun); err != nil {
-			return fmt.Errorf("error creating self hosted control plane: %v", err)
-		}
-	}
-	return nil
-}
-
 // getWaiter gets the right waiter implementation for the right occasion
 // TODO: Consolidate this with what's in init.go?
 func getWaiter(dryRun bool, client clientset.Interface) apiclient.Waiter {
@@ -207,57 +182,26 @@ func getKubeletDir(dryRun bool) (string, error) {
 	return kubeadmconstants.KubeletRunDirectory, nil
 }
 
-// backupAPIServerCertAndKey backups the old cert and key of kube-apiserver to a specified directory.
-func backupAPIServerCertAndKey(certAndKeyDir string) error {
-	subDir := filepath.Join(certAndKeyDir, "expired")
-	if err := os.Mkdir(subDir, 0766); err != nil {
-		return fmt.Errorf("failed to created backup directory %s: %v", subDir, err)
-	}
-
-	filesToMove := map[string]string{
-		filepath.Join(certAndKeyDir, kubeadmconstants.APIServerCertName): filepath.Join(subDir, kubeadmconstants.APIServerCertName),
-		filepath.Join(certAndKeyDir, kubeadmconstants.APIServerKeyName):  filepath.Join(subDir, kubeadmconstants.APIServerKeyName),
-	}
-	return moveFiles(filesToMove)
-}
-
-// moveFiles moves files from one directory to another.
-func moveFiles(files map[string]string) error {
+// moveFiles moves files from one directory to another using mover, so this works the same
+// whether it's backed by the real filesystem or a dry-run stand-in.
+func moveFiles(mover FileMover, files map[string]string) error {
 	filesToRecover := map[string]string{}
 	for from, to := range files {
-		if err := os.Rename(from, to); err != nil {
-			return rollbackFiles(filesToRecover, err)
+		if err := mover.Rename(from, to); err != nil {
+			return rollbackFiles(mover, filesToRecover, err)
 		}
 		filesToRecover[to] = from
 	}
 	return nil
 }
 
-// rollbackFiles moves the files back to the original directory.
-func rollbackFiles(files map[string]string, originalErr error) error {
+// rollbackFiles moves the files back to the original directory using mover.
+func rollbackFiles(mover FileMover, files map[string]string, originalErr error) error {
 	errs := []error{originalErr}
 	for from, to := range files {
-		if err := os.Rename(from, to); err != nil {
+		if err := mover.Rename(from, to); err != nil {
 			errs = append(errs, err)
 		}
 	}
 	return fmt.Errorf("couldn't move these files: %v. Got errors: %v", files, errors.NewAggregate(errs))
 }
-
-// shouldBackupAPIServerCertAndKey checks if the cert of kube-apiserver will be expired in 180 days.
-func shouldBackupAPIServerCertAndKey(certAndKeyDir string) (bool, error) {
-	apiServerCert := filepath.Join(certAndKeyDir, kubeadmconstants.APIServerCertName)
-	certs, err := certutil.CertsFromFile(apiServerCert)
-	if err != nil {
-		return false, fmt.Errorf("couldn't load the certificate file %s: %v", apiServerCert, err)
-	}
-	if len(certs) == 0 {
-		return false, fmt.Errorf("no certificate data found")
-	}
-
-	if time.Now().Sub(certs[0].NotBefore) > expiry {
-		return true, nil
-	}
-
-	return false, nil
-}
\ No newline at end of file
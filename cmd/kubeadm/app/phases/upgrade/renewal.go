@@ -0,0 +1,272 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package upgrade
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	certutil "k8s.io/client-go/util/cert"
+	kubeadmapi "k8s.io/kubernetes/cmd/kubeadm/app/apis/kubeadm"
+	kubeadmconstants "k8s.io/kubernetes/cmd/kubeadm/app/constants"
+	certsphase "k8s.io/kubernetes/cmd/kubeadm/app/phases/certs"
+)
+
+// defaultCertificateRenewalThreshold is how far in advance of expiry kubeadm proactively
+// regenerates a certificate during an upgrade, used by RenewExpiringCertificates. A caller
+// that needs a different threshold today (there's no MasterConfiguration field or
+// --cert-renewal-threshold flag for an operator to set one yet) can call
+// RenewExpiringCertificatesWithThreshold instead.
+const defaultCertificateRenewalThreshold = 180 * 24 * time.Hour
+
+// expiredCertsDir is the subdirectory of the PKI directory that backups of replaced
+// certificates are moved into, namespaced by the RFC3339 timestamp of the upgrade that
+// replaced them so that repeated upgrades don't collide on the same backup location.
+const expiredCertsDir = "expired"
+
+// certRenewSpec describes one cert/key pair kubeadm manages under the PKI directory and
+// how to regenerate it once it's close to expiring.
+type certRenewSpec struct {
+	certName string
+	keyName  string
+	create   func(cfg *kubeadmapi.MasterConfiguration) error
+	// etcd is true for certs that only exist because kubeadm manages a local etcd
+	// member; they have no meaning, and aren't present on disk, when cfg.Etcd.External
+	// is set.
+	etcd bool
+	// mainCA is true for certs signed by the cluster's main CA (ca.crt/ca.key), the only
+	// CA MasterConfiguration lets an operator keep external to kubeadm. The front-proxy
+	// CA and the etcd CA are each separate from it and always fully kubeadm-managed
+	// (aside from cfg.Etcd.External, which the etcd field above already accounts for), so
+	// they never go through the external-CA CSR fallback below.
+	mainCA bool
+}
+
+// certRenewSpecs enumerates the full kubeadm-managed PKI tree under certAndKeyDir.
+//
+// sa.key/sa.pub, the ServiceAccount signing key pair, are deliberately absent here: they're
+// a raw RSA key pair, not an X.509 certificate, so they have no NotAfter for
+// certNearingExpiry to check and nothing for certsphase.UsingExternalCA to say about them.
+var certRenewSpecs = []certRenewSpec{
+	{certName: kubeadmconstants.APIServerCertName, keyName: kubeadmconstants.APIServerKeyName, create: certsphase.CreateAPIServerCertAndKeyFiles, mainCA: true},
+	{certName: kubeadmconstants.APIServerKubeletClientCertName, keyName: kubeadmconstants.APIServerKubeletClientKeyName, create: certsphase.CreateAPIServerKubeletClientCertAndKeyFiles, mainCA: true},
+	{certName: kubeadmconstants.FrontProxyCACertName, keyName: kubeadmconstants.FrontProxyCAKeyName, create: certsphase.CreateFrontProxyCACertAndKeyFiles},
+	{certName: kubeadmconstants.FrontProxyClientCertName, keyName: kubeadmconstants.FrontProxyClientKeyName, create: certsphase.CreateFrontProxyClientCertAndKeyFiles},
+	{certName: kubeadmconstants.EtcdCACertName, keyName: kubeadmconstants.EtcdCAKeyName, create: certsphase.CreateEtcdCACertAndKeyFiles, etcd: true},
+	{certName: kubeadmconstants.EtcdServerCertName, keyName: kubeadmconstants.EtcdServerKeyName, create: certsphase.CreateEtcdServerCertAndKeyFiles, etcd: true},
+	{certName: kubeadmconstants.EtcdPeerCertName, keyName: kubeadmconstants.EtcdPeerKeyName, create: certsphase.CreateEtcdPeerCertAndKeyFiles, etcd: true},
+	{certName: kubeadmconstants.EtcdHealthcheckClientCertName, keyName: kubeadmconstants.EtcdHealthcheckClientKeyName, create: certsphase.CreateEtcdHealthcheckClientCertAndKeyFiles, etcd: true},
+	{certName: kubeadmconstants.APIServerEtcdClientCertName, keyName: kubeadmconstants.APIServerEtcdClientKeyName, create: certsphase.CreateAPIServerEtcdClientCertAndKeyFiles, etcd: true},
+}
+
+// skipDueToExternalEtcd reports whether spec should be skipped outright because it's an
+// etcd-only cert and cfg.Etcd.External is set: kubeadm never wrote it and has nothing
+// useful to renew.
+func skipDueToExternalEtcd(spec certRenewSpec, externalEtcd bool) bool {
+	return spec.etcd && externalEtcd
+}
+
+// isExternallySigned reports whether spec's issuing CA is external to kubeadm (kubeadm
+// holds the CA certificate but not its private key) given mainCAExternal, the result of
+// certsphase.UsingExternalCA(cfg). Only specs signed by the main CA are ever affected by
+// it: the front-proxy and etcd CAs are separate CAs kubeadm fully manages, so a main CA
+// that's external doesn't change how they're renewed.
+func isExternallySigned(spec certRenewSpec, mainCAExternal bool) bool {
+	return spec.mainCA && mainCAExternal
+}
+
+// RenewExpiringCertificates walks every cert/key pair kubeadm manages under certAndKeyDir
+// and regenerates any whose remaining validity has dropped below cfg's renewal threshold.
+// Each certsphase.Create* func re-derives its CN and SANs from cfg, the same source the
+// original certificate was created from, so they normally come out the same; for the
+// apiserver certificate specifically, where a SAN can come from an extra source that isn't
+// durably recorded in cfg (e.g. --apiserver-cert-extra-sans at cluster creation time),
+// preserveAPIServerSANs also folds the existing certificate's own SANs into
+// cfg.APIServerCertSANs first, so renewal never silently drops one. Old files are moved
+// aside into a timestamped backup directory first; if any regeneration fails, every file
+// moved so far during this call is restored so certAndKeyDir is left exactly as it was
+// found. On success it returns a map of backup path to original path for every file it
+// moved, so a caller that later needs to undo the whole renewal can pass it to
+// restoreFiles.
+//
+// Certs backed by an etcd member kubeadm doesn't manage (cfg.Etcd.External != nil) are
+// skipped entirely: kubeadm never wrote them and has nothing useful to renew. Certs
+// kubeadm did write but can't re-sign because it was only ever given the CA certificate,
+// not its private key (certsphase.UsingExternalCA(cfg)), are left alone too; instead a CSR
+// is written next to each one nearing expiry for an operator's cert-manager/Vault pipeline
+// to sign.
+//
+// When dryRun is true, the backup move is only logged, never actually performed, via the
+// dry-run FileMover, and spec.create is never called either: the original cert and key are
+// left in place on disk exactly as found, and the returned map is empty, since there's
+// nothing to roll back. The external-CA CSR write is skipped the same way: only the path
+// it would have used is logged, and writeCSRForExternalCA is never called.
+//
+// The renewal threshold used is always defaultCertificateRenewalThreshold; use
+// RenewExpiringCertificatesWithThreshold to override it.
+func RenewExpiringCertificates(cfg *kubeadmapi.MasterConfiguration, certAndKeyDir string, dryRun bool) (map[string]string, error) {
+	return renewExpiringCertificates(cfg, certAndKeyDir, dryRun, defaultCertificateRenewalThreshold)
+}
+
+// RenewExpiringCertificatesWithThreshold is RenewExpiringCertificates, but lets the caller
+// override the renewal threshold instead of always using
+// defaultCertificateRenewalThreshold. It's a separate function, rather than a parameter
+// added to RenewExpiringCertificates itself, so existing callers of that signature keep
+// compiling; wiring a --cert-renewal-threshold flag (or a MasterConfiguration field) through
+// to this from `kubeadm upgrade apply` is still TODO outside this package.
+func RenewExpiringCertificatesWithThreshold(cfg *kubeadmapi.MasterConfiguration, certAndKeyDir string, dryRun bool, threshold time.Duration) (map[string]string, error) {
+	return renewExpiringCertificates(cfg, certAndKeyDir, dryRun, threshold)
+}
+
+func renewExpiringCertificates(cfg *kubeadmapi.MasterConfiguration, certAndKeyDir string, dryRun bool, threshold time.Duration) (map[string]string, error) {
+	externalEtcd := cfg.Etcd.External != nil
+	mainCAExternal, err := certsphase.UsingExternalCA(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't determine whether the cluster CA is external: %v", err)
+	}
+	mover := getFileMover(dryRun)
+
+	var backupDir string
+	moved := map[string]string{}
+	for _, spec := range certRenewSpecs {
+		if skipDueToExternalEtcd(spec, externalEtcd) {
+			continue
+		}
+
+		certPath := filepath.Join(certAndKeyDir, spec.certName)
+		expiring, err := certNearingExpiry(certPath, threshold)
+		if err != nil {
+			fmt.Printf("[postupgrade] WARNING: failed to determine expiry of %s: %v\n", certPath, err)
+			continue
+		}
+		if !expiring {
+			continue
+		}
+
+		if isExternallySigned(spec, mainCAExternal) {
+			if dryRun {
+				csrPath := filepath.Join(certAndKeyDir, strings.TrimSuffix(spec.certName, filepath.Ext(spec.certName))+".csr")
+				fmt.Printf("[postupgrade] %s is using an externally managed CA; %s would be written for an operator to sign\n", spec.certName, csrPath)
+				continue
+			}
+			csrPath, err := writeCSRForExternalCA(certAndKeyDir, spec)
+			if err != nil {
+				fmt.Printf("[postupgrade] WARNING: failed to write CSR for %s: %v\n", spec.certName, err)
+				continue
+			}
+			fmt.Printf("[postupgrade] %s is using an externally managed CA; wrote %s for an operator to sign\n", spec.certName, csrPath)
+			continue
+		}
+
+		if spec.certName == kubeadmconstants.APIServerCertName {
+			if err := preserveAPIServerSANs(certPath, cfg); err != nil {
+				fmt.Printf("[postupgrade] WARNING: couldn't read the existing SANs of %s, renewing with cfg's own SANs only: %v\n", spec.certName, err)
+			}
+		}
+
+		if backupDir == "" {
+			backupDir, err = newExpiredCertsBackupDir(mover, certAndKeyDir)
+			if err != nil {
+				return moved, rollbackFiles(mover, moved, err)
+			}
+		}
+
+		toMove := map[string]string{
+			certPath: filepath.Join(backupDir, spec.certName),
+			filepath.Join(certAndKeyDir, spec.keyName): filepath.Join(backupDir, spec.keyName),
+		}
+		if err := moveFiles(mover, toMove); err != nil {
+			return moved, rollbackFiles(mover, moved, err)
+		}
+
+		if dryRun {
+			fmt.Printf("[postupgrade] %s would be renewed (previous cert and key would be backed up to %s)\n", spec.certName, backupDir)
+			continue
+		}
+
+		for from, to := range toMove {
+			moved[to] = from
+		}
+
+		if err := spec.create(cfg); err != nil {
+			return moved, rollbackFiles(mover, moved, fmt.Errorf("couldn't renew %s: %v", spec.certName, err))
+		}
+		fmt.Printf("[postupgrade] renewed %s (previous cert and key backed up to %s)\n", spec.certName, backupDir)
+	}
+	return moved, nil
+}
+
+// newExpiredCertsBackupDir creates a fresh, timestamped backup directory under
+// certAndKeyDir/expired so that concurrent or repeated upgrades never collide trying to
+// move files into the same location.
+func newExpiredCertsBackupDir(mover FileMover, certAndKeyDir string) (string, error) {
+	dir := filepath.Join(certAndKeyDir, expiredCertsDir, time.Now().Format(time.RFC3339))
+	if err := mover.MkdirAll(dir); err != nil {
+		return "", fmt.Errorf("failed to create backup directory %s: %v", dir, err)
+	}
+	return dir, nil
+}
+
+// certNearingExpiry reports whether the certificate at certPath has less than threshold
+// remaining before it expires.
+func certNearingExpiry(certPath string, threshold time.Duration) (bool, error) {
+	certs, err := certutil.CertsFromFile(certPath)
+	if err != nil {
+		return false, fmt.Errorf("couldn't load the certificate file %s: %v", certPath, err)
+	}
+	if len(certs) == 0 {
+		return false, fmt.Errorf("no certificate data found in %s", certPath)
+	}
+	return certs[0].NotAfter.Sub(time.Now()) < threshold, nil
+}
+
+// preserveAPIServerSANs reads the DNS names and IP addresses of the certificate currently
+// at certPath and merges any not already present into cfg.APIServerCertSANs. Without this,
+// certsphase.CreateAPIServerCertAndKeyFiles derives the renewed certificate's SANs entirely
+// afresh from cfg, the same way writeCSRForExternalCA reuses the old certificate's Subject
+// and SANs rather than recomputing them from cfg for the external-CA case; a SAN present
+// only because it was passed on the command line at cluster creation time (rather than
+// recorded in cfg) would otherwise be silently dropped on the next renewal.
+func preserveAPIServerSANs(certPath string, cfg *kubeadmapi.MasterConfiguration) error {
+	certs, err := certutil.CertsFromFile(certPath)
+	if err != nil {
+		return fmt.Errorf("couldn't load the certificate file %s: %v", certPath, err)
+	}
+	if len(certs) == 0 {
+		return fmt.Errorf("no certificate data found in %s", certPath)
+	}
+
+	existing := map[string]bool{}
+	for _, san := range cfg.APIServerCertSANs {
+		existing[san] = true
+	}
+	addSAN := func(san string) {
+		if !existing[san] {
+			cfg.APIServerCertSANs = append(cfg.APIServerCertSANs, san)
+			existing[san] = true
+		}
+	}
+	for _, name := range certs[0].DNSNames {
+		addSAN(name)
+	}
+	for _, ip := range certs[0].IPAddresses {
+		addSAN(ip.String())
+	}
+	return nil
+}
@@ -0,0 +1,406 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package upgrade
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	kubeadmapi "k8s.io/kubernetes/cmd/kubeadm/app/apis/kubeadm"
+	kubeadmconstants "k8s.io/kubernetes/cmd/kubeadm/app/constants"
+)
+
+func TestSkipDueToExternalEtcd(t *testing.T) {
+	tests := []struct {
+		name         string
+		spec         certRenewSpec
+		externalEtcd bool
+		want         bool
+	}{
+		{name: "etcd cert, external etcd", spec: certRenewSpec{etcd: true}, externalEtcd: true, want: true},
+		{name: "etcd cert, local etcd", spec: certRenewSpec{etcd: true}, externalEtcd: false, want: false},
+		{name: "non-etcd cert, external etcd", spec: certRenewSpec{etcd: false}, externalEtcd: true, want: false},
+		{name: "non-etcd cert, local etcd", spec: certRenewSpec{etcd: false}, externalEtcd: false, want: false},
+	}
+	for _, rt := range tests {
+		t.Run(rt.name, func(t *testing.T) {
+			if got := skipDueToExternalEtcd(rt.spec, rt.externalEtcd); got != rt.want {
+				t.Errorf("skipDueToExternalEtcd() = %v, want %v", got, rt.want)
+			}
+		})
+	}
+}
+
+func TestIsExternallySigned(t *testing.T) {
+	tests := []struct {
+		name           string
+		spec           certRenewSpec
+		mainCAExternal bool
+		want           bool
+	}{
+		{name: "main CA cert, external main CA", spec: certRenewSpec{mainCA: true}, mainCAExternal: true, want: true},
+		{name: "main CA cert, kubeadm-managed main CA", spec: certRenewSpec{mainCA: true}, mainCAExternal: false, want: false},
+		{name: "front-proxy cert, external main CA", spec: certRenewSpec{mainCA: false, etcd: false}, mainCAExternal: true, want: false},
+		{name: "etcd cert, external main CA", spec: certRenewSpec{mainCA: false, etcd: true}, mainCAExternal: true, want: false},
+	}
+	for _, rt := range tests {
+		t.Run(rt.name, func(t *testing.T) {
+			if got := isExternallySigned(rt.spec, rt.mainCAExternal); got != rt.want {
+				t.Errorf("isExternallySigned() = %v, want %v", got, rt.want)
+			}
+		})
+	}
+}
+
+// TestCertRenewSpecsCAFamilies pins down which certs in the real certRenewSpecs table are
+// main-CA-signed and which are etcd-only, so a future entry added to the wrong family
+// silently regresses the external-CA/external-etcd handling these tests exercise above.
+func TestCertRenewSpecsCAFamilies(t *testing.T) {
+	wantMainCA := map[string]bool{
+		kubeadmconstants.APIServerCertName:              true,
+		kubeadmconstants.APIServerKubeletClientCertName: true,
+	}
+	wantEtcd := map[string]bool{
+		kubeadmconstants.EtcdCACertName:                true,
+		kubeadmconstants.EtcdServerCertName:            true,
+		kubeadmconstants.EtcdPeerCertName:              true,
+		kubeadmconstants.EtcdHealthcheckClientCertName: true,
+		kubeadmconstants.APIServerEtcdClientCertName:   true,
+	}
+
+	for _, spec := range certRenewSpecs {
+		if spec.mainCA != wantMainCA[spec.certName] {
+			t.Errorf("%s: mainCA = %v, want %v", spec.certName, spec.mainCA, wantMainCA[spec.certName])
+		}
+		if spec.etcd != wantEtcd[spec.certName] {
+			t.Errorf("%s: etcd = %v, want %v", spec.certName, spec.etcd, wantEtcd[spec.certName])
+		}
+		if spec.mainCA && spec.etcd {
+			t.Errorf("%s: a cert can't be both mainCA and etcd", spec.certName)
+		}
+	}
+}
+
+// TestPreserveAPIServerSANs proves that preserveAPIServerSANs folds the existing
+// certificate's SANs into cfg.APIServerCertSANs without duplicating ones already there.
+func TestPreserveAPIServerSANs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "renewal-test-preserve-sans")
+	if err != nil {
+		t.Fatalf("couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestCertAndKeyWithSANs(t, dir, kubeadmconstants.APIServerCertName, kubeadmconstants.APIServerKeyName, "kube-apiserver",
+		[]string{"kubernetes.default.svc", "custom.example.com"}, time.Now().Add(time.Hour))
+
+	cfg := &kubeadmapi.MasterConfiguration{APIServerCertSANs: []string{"kubernetes.default.svc"}}
+	if err := preserveAPIServerSANs(filepath.Join(dir, kubeadmconstants.APIServerCertName), cfg); err != nil {
+		t.Fatalf("preserveAPIServerSANs() error = %v", err)
+	}
+
+	want := map[string]bool{"kubernetes.default.svc": true, "custom.example.com": true}
+	if len(cfg.APIServerCertSANs) != len(want) {
+		t.Fatalf("APIServerCertSANs = %v, want exactly %v", cfg.APIServerCertSANs, want)
+	}
+	for _, san := range cfg.APIServerCertSANs {
+		if !want[san] {
+			t.Errorf("unexpected SAN %q in %v", san, cfg.APIServerCertSANs)
+		}
+	}
+}
+
+// writeTestCertAndKey writes a self-signed certificate (with the given NotAfter) and its
+// RSA private key to certAndKeyDir under certName/keyName, the on-disk layout
+// RenewExpiringCertificates and writeCSRForExternalCA both expect.
+func writeTestCertAndKey(t *testing.T, certAndKeyDir, certName, keyName, commonName string, notAfter time.Time) {
+	t.Helper()
+	der, key := newTestCert(t, commonName, nil, notAfter)
+	writeTestFile(t, certAndKeyDir, certName, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	writeTestFile(t, certAndKeyDir, keyName, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+}
+
+// writeTestCertAndKeyWithSANs is writeTestCertAndKey, but lets the caller set the
+// certificate's DNS SANs too, for tests exercising SAN-preserving renewal.
+func writeTestCertAndKeyWithSANs(t *testing.T, certAndKeyDir, certName, keyName, commonName string, dnsNames []string, notAfter time.Time) {
+	t.Helper()
+	der, key := newTestCert(t, commonName, dnsNames, notAfter)
+	writeTestFile(t, certAndKeyDir, certName, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	writeTestFile(t, certAndKeyDir, keyName, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+}
+
+// writeTestCertOnly writes only a self-signed certificate, no key, simulating a CA kubeadm
+// was handed the certificate for but not the private key to.
+func writeTestCertOnly(t *testing.T, certAndKeyDir, certName, commonName string, notAfter time.Time) {
+	t.Helper()
+	der, _ := newTestCert(t, commonName, nil, notAfter)
+	writeTestFile(t, certAndKeyDir, certName, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func newTestCert(t *testing.T, commonName string, dnsNames []string, notAfter time.Time) ([]byte, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("couldn't generate test key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		NotBefore:    notAfter.Add(-365 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("couldn't create test certificate: %v", err)
+	}
+	return der, key
+}
+
+func writeTestFile(t *testing.T, dir, name string, content []byte) {
+	t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0600); err != nil {
+		t.Fatalf("couldn't write %s: %v", name, err)
+	}
+}
+
+// captureStdout runs fn with os.Stdout redirected to a pipe and returns everything fn
+// printed, so tests can assert on RenewExpiringCertificates's human-readable [postupgrade]
+// progress messages without plumbing a writer through it.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("couldn't create pipe: %v", err)
+	}
+	orig := os.Stdout
+	os.Stdout = w
+	fn()
+	os.Stdout = orig
+	w.Close()
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, r); err != nil {
+		t.Fatalf("couldn't read captured stdout: %v", err)
+	}
+	return buf.String()
+}
+
+// TestWriteCSRForExternalCA exercises the function RenewExpiringCertificates falls back to
+// for a spec whose CA is external: it must reuse the on-disk cert's CN/SANs and leave the
+// original cert and key untouched.
+func TestWriteCSRForExternalCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "renewal-test-csr")
+	if err != nil {
+		t.Fatalf("couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	spec := certRenewSpec{certName: kubeadmconstants.APIServerCertName, keyName: kubeadmconstants.APIServerKeyName, mainCA: true}
+	writeTestCertAndKey(t, dir, spec.certName, spec.keyName, "kube-apiserver", time.Now().Add(24*time.Hour))
+
+	csrPath, err := writeCSRForExternalCA(dir, spec)
+	if err != nil {
+		t.Fatalf("writeCSRForExternalCA() error = %v", err)
+	}
+	if _, err := os.Stat(csrPath); err != nil {
+		t.Errorf("expected a CSR file at %s: %v", csrPath, err)
+	}
+	if _, err := os.Stat(csrPath + ".json"); err != nil {
+		t.Errorf("expected a CSR summary file at %s.json: %v", csrPath, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, spec.certName)); err != nil {
+		t.Errorf("original certificate should still be present: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, spec.keyName)); err != nil {
+		t.Errorf("original key should still be present: %v", err)
+	}
+}
+
+// TestRenewExpiringCertificates_ExternalEtcd is an integration test proving that, end to
+// end, an externally-managed etcd cluster makes RenewExpiringCertificates skip every
+// etcd-only cert outright while still considering the main-CA certs it's expected to.
+func TestRenewExpiringCertificates_ExternalEtcd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "renewal-test-etcd")
+	if err != nil {
+		t.Fatalf("couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// kubeadm owns the main CA's key, so certsphase.UsingExternalCA reports it as not
+	// external: both ca.crt and ca.key are on disk.
+	writeTestCertAndKey(t, dir, kubeadmconstants.CACertName, kubeadmconstants.CAKeyName, "kubernetes", time.Now().Add(10*365*24*time.Hour))
+	writeTestCertAndKey(t, dir, kubeadmconstants.APIServerCertName, kubeadmconstants.APIServerKeyName, "kube-apiserver", time.Now().Add(time.Hour))
+
+	cfg := &kubeadmapi.MasterConfiguration{
+		CertificatesDir: dir,
+		Etcd:            kubeadmapi.Etcd{External: &kubeadmapi.ExternalEtcd{}},
+	}
+
+	var moved map[string]string
+	output := captureStdout(t, func() {
+		moved, err = RenewExpiringCertificates(cfg, dir, true)
+	})
+	if err != nil {
+		t.Fatalf("RenewExpiringCertificates() error = %v", err)
+	}
+	if len(moved) != 0 {
+		t.Errorf("expected no files moved under dry-run, got %v", moved)
+	}
+
+	for _, spec := range certRenewSpecs {
+		if spec.etcd && strings.Contains(output, spec.certName) {
+			t.Errorf("expected %s to be skipped outright for external etcd, but it appeared in the output:\n%s", spec.certName, output)
+		}
+	}
+	if !strings.Contains(output, kubeadmconstants.APIServerCertName) {
+		t.Errorf("expected %s to be considered for renewal, got output:\n%s", kubeadmconstants.APIServerCertName, output)
+	}
+}
+
+// TestRenewExpiringCertificatesWithThreshold proves that the threshold argument, not just
+// defaultCertificateRenewalThreshold, governs which certs RenewExpiringCertificatesWithThreshold
+// considers nearing expiry.
+func TestRenewExpiringCertificatesWithThreshold(t *testing.T) {
+	dir, err := ioutil.TempDir("", "renewal-test-threshold")
+	if err != nil {
+		t.Fatalf("couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// kubeadm owns the main CA's key, so certsphase.UsingExternalCA reports it as not
+	// external: both ca.crt and ca.key are on disk.
+	writeTestCertAndKey(t, dir, kubeadmconstants.CACertName, kubeadmconstants.CAKeyName, "kubernetes", time.Now().Add(10*365*24*time.Hour))
+	writeTestCertAndKey(t, dir, kubeadmconstants.APIServerCertName, kubeadmconstants.APIServerKeyName, "kube-apiserver", time.Now().Add(24*time.Hour))
+
+	cfg := &kubeadmapi.MasterConfiguration{
+		CertificatesDir: dir,
+		Etcd:            kubeadmapi.Etcd{External: &kubeadmapi.ExternalEtcd{}},
+	}
+
+	// The cert expires in 24 hours: the default 180-day threshold would consider it
+	// expiring, but a 1-hour threshold shouldn't.
+	output := captureStdout(t, func() {
+		_, err = RenewExpiringCertificatesWithThreshold(cfg, dir, true, time.Hour)
+	})
+	if err != nil {
+		t.Fatalf("RenewExpiringCertificatesWithThreshold() error = %v", err)
+	}
+	if strings.Contains(output, kubeadmconstants.APIServerCertName) {
+		t.Errorf("expected %s not to be considered for renewal under a 1-hour threshold, got output:\n%s", kubeadmconstants.APIServerCertName, output)
+	}
+}
+
+// TestRenewExpiringCertificates_ExternalCA is an integration test proving that, end to
+// end, a main CA kubeadm only holds the certificate for (not the key) makes
+// RenewExpiringCertificates write a CSR for the affected cert instead of regenerating it,
+// and that under dry-run it only logs the CSR it would write, never actually writing it.
+func TestRenewExpiringCertificates_ExternalCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "renewal-test-ca")
+	if err != nil {
+		t.Fatalf("couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Only ca.crt is on disk, not ca.key: certsphase.UsingExternalCA reports the main CA
+	// as external.
+	writeTestCertOnly(t, dir, kubeadmconstants.CACertName, "kubernetes", time.Now().Add(10*365*24*time.Hour))
+	writeTestCertAndKey(t, dir, kubeadmconstants.APIServerCertName, kubeadmconstants.APIServerKeyName, "kube-apiserver", time.Now().Add(time.Hour))
+
+	cfg := &kubeadmapi.MasterConfiguration{
+		CertificatesDir: dir,
+		Etcd:            kubeadmapi.Etcd{External: &kubeadmapi.ExternalEtcd{}},
+	}
+
+	base := strings.TrimSuffix(kubeadmconstants.APIServerCertName, filepath.Ext(kubeadmconstants.APIServerCertName))
+	csrPath := filepath.Join(dir, base+".csr")
+
+	var moved map[string]string
+	output := captureStdout(t, func() {
+		moved, err = RenewExpiringCertificates(cfg, dir, true)
+	})
+	if err != nil {
+		t.Fatalf("RenewExpiringCertificates() error = %v", err)
+	}
+	if len(moved) != 0 {
+		t.Errorf("expected no files moved: the apiserver cert should have been deflected to a CSR, not renewed, got %v", moved)
+	}
+	if !strings.Contains(output, "externally managed CA") {
+		t.Errorf("expected the externally-signed apiserver cert to be called out, got output:\n%s", output)
+	}
+	if !strings.Contains(output, csrPath) {
+		t.Errorf("expected the CSR path to be logged, got output:\n%s", output)
+	}
+	// Dry-run must never touch disk: writeCSRForExternalCA is only ever called for real.
+	if _, err := os.Stat(csrPath); !os.IsNotExist(err) {
+		t.Errorf("expected no CSR file to be written under dry-run, but %s exists (err = %v)", csrPath, err)
+	}
+	if _, err := os.Stat(csrPath + ".json"); !os.IsNotExist(err) {
+		t.Errorf("expected no CSR summary file to be written under dry-run, but %s.json exists (err = %v)", csrPath, err)
+	}
+	// The cert and key kubeadm already had on disk must be left alone: there's no CA key
+	// to regenerate them with.
+	if _, err := os.Stat(filepath.Join(dir, kubeadmconstants.APIServerCertName)); err != nil {
+		t.Errorf("original apiserver cert should still be present: %v", err)
+	}
+}
+
+// TestRenewExpiringCertificates_ExternalCANotDryRun proves that outside of dry-run,
+// RenewExpiringCertificates does write the CSR (and its JSON summary) to disk: dry-run is
+// the only thing that should suppress it.
+func TestRenewExpiringCertificates_ExternalCANotDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "renewal-test-ca-real")
+	if err != nil {
+		t.Fatalf("couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestCertOnly(t, dir, kubeadmconstants.CACertName, "kubernetes", time.Now().Add(10*365*24*time.Hour))
+	writeTestCertAndKey(t, dir, kubeadmconstants.APIServerCertName, kubeadmconstants.APIServerKeyName, "kube-apiserver", time.Now().Add(time.Hour))
+
+	cfg := &kubeadmapi.MasterConfiguration{
+		CertificatesDir: dir,
+		Etcd:            kubeadmapi.Etcd{External: &kubeadmapi.ExternalEtcd{}},
+	}
+
+	captureStdout(t, func() {
+		_, err = RenewExpiringCertificates(cfg, dir, false)
+	})
+	if err != nil {
+		t.Fatalf("RenewExpiringCertificates() error = %v", err)
+	}
+
+	base := strings.TrimSuffix(kubeadmconstants.APIServerCertName, filepath.Ext(kubeadmconstants.APIServerCertName))
+	csrPath := filepath.Join(dir, base+".csr")
+	if _, err := os.Stat(csrPath); err != nil {
+		t.Errorf("expected a CSR file to be written for the apiserver cert: %v", err)
+	}
+	if _, err := os.Stat(csrPath + ".json"); err != nil {
+		t.Errorf("expected a CSR summary file to be written: %v", err)
+	}
+}
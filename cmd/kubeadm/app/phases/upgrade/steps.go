@@ -0,0 +1,399 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package upgrade
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	kubeadmapi "k8s.io/kubernetes/cmd/kubeadm/app/apis/kubeadm"
+	kubeadmconstants "k8s.io/kubernetes/cmd/kubeadm/app/constants"
+	"k8s.io/kubernetes/cmd/kubeadm/app/features"
+	kubeletphase "k8s.io/kubernetes/cmd/kubeadm/app/phases/kubelet"
+	"k8s.io/kubernetes/cmd/kubeadm/app/phases/selfhosting"
+	"k8s.io/kubernetes/cmd/kubeadm/app/phases/uploadconfig"
+	"k8s.io/kubernetes/cmd/kubeadm/app/util/apiclient"
+	"k8s.io/kubernetes/pkg/util/version"
+)
+
+// postUpgradeStep is one mutating, non-idempotent action PerformPostUpgradeTasks performs.
+// Rollback must undo exactly what Apply did, using state Apply captured beforehand, and is
+// only ever invoked for a step whose Apply already succeeded.
+type postUpgradeStep interface {
+	Name() string
+	Apply() error
+	Rollback() error
+}
+
+// stepExecutor runs postUpgradeSteps, remembering which of them completed so that, unless
+// rollback has been disabled, a later failure can be unwound in reverse order.
+type stepExecutor struct {
+	rollbackOnError bool
+
+	applied []postUpgradeStep
+	aborted bool
+}
+
+// run applies step. If it fails and rollback is enabled, every step applied so far during
+// this executor's lifetime is rolled back in reverse order and aborted is set, signalling
+// the caller to stop running further transactional steps.
+func (e *stepExecutor) run(step postUpgradeStep) error {
+	if err := step.Apply(); err != nil {
+		wrapped := fmt.Errorf("%s: %v", step.Name(), err)
+		if e.rollbackOnError {
+			e.unwind()
+			e.aborted = true
+		}
+		return wrapped
+	}
+	e.applied = append(e.applied, step)
+	return nil
+}
+
+// unwind rolls back every applied step, most-recently-applied first.
+func (e *stepExecutor) unwind() {
+	for i := len(e.applied) - 1; i >= 0; i-- {
+		step := e.applied[i]
+		if err := step.Rollback(); err != nil {
+			fmt.Printf("[postupgrade] WARNING: failed to roll back %q: %v\n", step.Name(), err)
+		}
+	}
+	e.applied = nil
+}
+
+// restoreConfigMap restores the state of the named ConfigMap as it was before a step's
+// Apply wrote it, from prior, a DeepCopy taken right before that write. If prior is nil,
+// the ConfigMap didn't exist before Apply and is deleted instead. prior's own
+// ResourceVersion is always stale by the time Rollback runs, since Apply already wrote a
+// newer one; an Update using it as-is would always fail with a 409 Conflict, so this
+// re-Gets the ConfigMap's current ResourceVersion immediately before every Update attempt
+// and retries if another write raced it.
+func restoreConfigMap(client clientset.Interface, name string, prior *corev1.ConfigMap) error {
+	configMaps := client.CoreV1().ConfigMaps(metav1.NamespaceSystem)
+	if prior == nil {
+		err := configMaps.Delete(name, &metav1.DeleteOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := configMaps.Get(name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		restore := prior.DeepCopy()
+		restore.ResourceVersion = current.ResourceVersion
+		_, err = configMaps.Update(restore)
+		return err
+	})
+}
+
+// restoreFiles moves previously-moved files back to their original location using mover.
+// Unlike rollbackFiles, it doesn't wrap the result around a triggering error: it's used
+// for voluntary rollback of a move that itself succeeded, not for recovering from a failed
+// one.
+func restoreFiles(mover FileMover, files map[string]string) error {
+	errs := []error{}
+	for from, to := range files {
+		if err := mover.Rename(from, to); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("couldn't restore these files: %v. Got errors: %v", files, errs)
+}
+
+// uploadConfigStep uploads the MasterConfiguration used for this upgrade to the
+// kubeadm-config ConfigMap, remembering whatever was there before so it can be restored.
+type uploadConfigStep struct {
+	client clientset.Interface
+	cfg    *kubeadmapi.MasterConfiguration
+
+	prior *corev1.ConfigMap
+}
+
+func (s *uploadConfigStep) Name() string { return "upload-configuration" }
+
+func (s *uploadConfigStep) Apply() error {
+	configMaps := s.client.CoreV1().ConfigMaps(metav1.NamespaceSystem)
+	prior, err := configMaps.Get(kubeadmconstants.InitConfigurationConfigMap, metav1.GetOptions{})
+	if err == nil {
+		s.prior = prior.DeepCopy()
+	} else if !apierrors.IsNotFound(err) {
+		return err
+	}
+	return uploadconfig.UploadConfiguration(s.cfg, s.client)
+}
+
+func (s *uploadConfigStep) Rollback() error {
+	return restoreConfigMap(s.client, kubeadmconstants.InitConfigurationConfigMap, s.prior)
+}
+
+// kubeletConfigMapStep creates or updates the version-branched kubelet ComponentConfig
+// ConfigMap (kubelet-config-1.x) for newK8sVer, remembering whatever was there before so
+// it can be restored.
+type kubeletConfigMapStep struct {
+	client    clientset.Interface
+	cfg       *kubeadmapi.MasterConfiguration
+	newK8sVer *version.Version
+
+	configMapName string
+	prior         *corev1.ConfigMap
+}
+
+func (s *kubeletConfigMapStep) Name() string { return "create-kubelet-config-map" }
+
+func (s *kubeletConfigMapStep) Apply() error {
+	s.configMapName = kubeadmconstants.GetKubeletConfigMapName(s.newK8sVer)
+	configMaps := s.client.CoreV1().ConfigMaps(metav1.NamespaceSystem)
+	prior, err := configMaps.Get(s.configMapName, metav1.GetOptions{})
+	if err == nil {
+		s.prior = prior.DeepCopy()
+	} else if !apierrors.IsNotFound(err) {
+		return err
+	}
+	return kubeletphase.CreateConfigMap(s.cfg, s.client)
+}
+
+func (s *kubeletConfigMapStep) Rollback() error {
+	return restoreConfigMap(s.client, s.configMapName, s.prior)
+}
+
+// selfHostingStep converts the static Pod-hosted control plane into a self-hosted one,
+// remembering the static Pod manifests the kubelet was serving it from beforehand so
+// Rollback can both restore them and delete the self-hosted DaemonSets Apply created.
+type selfHostingStep struct {
+	client clientset.Interface
+	cfg    *kubeadmapi.MasterConfiguration
+	dryRun bool
+
+	converted      bool
+	staticPodFiles map[string][]byte
+}
+
+func (s *selfHostingStep) Name() string { return "convert-to-self-hosted" }
+
+func (s *selfHostingStep) Apply() error {
+	if !features.Enabled(s.cfg.FeatureGates, features.SelfHosting) || IsControlPlaneSelfHosted(s.client) {
+		return nil
+	}
+
+	manifests, err := readManifestDir(kubeadmconstants.GetStaticPodDirectory())
+	if err != nil {
+		return err
+	}
+	s.staticPodFiles = manifests
+
+	waiter := getWaiter(s.dryRun, s.client)
+	fmt.Println("[self-hosted] Creating self-hosted control plane.")
+	if err := selfhosting.CreateSelfHostedControlPlane(kubeadmconstants.GetStaticPodDirectory(), kubeadmconstants.KubernetesDir, s.cfg, s.client, waiter, s.dryRun); err != nil {
+		return fmt.Errorf("error creating self hosted control plane: %v", err)
+	}
+	s.converted = true
+	return nil
+}
+
+func (s *selfHostingStep) Rollback() error {
+	if !s.converted {
+		return nil
+	}
+	// Put back the static Pod manifests the kubelet was serving the control plane from
+	// before the conversion, so the next kubelet sync switches back to them.
+	if err := writeManifestDir(kubeadmconstants.GetStaticPodDirectory(), s.staticPodFiles); err != nil {
+		return err
+	}
+	return deleteSelfHostedDaemonSets(s.client, s.staticPodFiles)
+}
+
+// deleteSelfHostedDaemonSets tears down the self-hosted DaemonSet
+// selfhosting.CreateSelfHostedControlPlane created for each static Pod manifest named in
+// staticPodFiles, so the node doesn't end up running both the restored static Pods and the
+// self-hosted DaemonSets at once. A component with no self-hosted DaemonSet (local etcd,
+// which never runs self-hosted) is tolerated.
+func deleteSelfHostedDaemonSets(client clientset.Interface, staticPodFiles map[string][]byte) error {
+	errs := []error{}
+	for fileName := range staticPodFiles {
+		component := strings.TrimSuffix(fileName, filepath.Ext(fileName))
+		name := kubeadmconstants.AddSelfHostedPrefix(component)
+		if err := apiclient.DeleteDaemonSetForeground(client, metav1.NamespaceSystem, name); err != nil && !apierrors.IsNotFound(err) {
+			errs = append(errs, fmt.Errorf("couldn't remove self-hosted DaemonSet %s: %v", name, err))
+		}
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("%v", errs)
+	}
+	return nil
+}
+
+// certRenewalStep regenerates any kubeadm-managed certificate nearing expiry.
+type certRenewalStep struct {
+	cfg           *kubeadmapi.MasterConfiguration
+	certAndKeyDir string
+	dryRun        bool
+
+	moved map[string]string
+}
+
+func (s *certRenewalStep) Name() string { return "renew-expiring-certificates" }
+
+func (s *certRenewalStep) Apply() error {
+	moved, err := RenewExpiringCertificates(s.cfg, s.certAndKeyDir, s.dryRun)
+	s.moved = moved
+	return err
+}
+
+func (s *certRenewalStep) Rollback() error {
+	if len(s.moved) == 0 {
+		return nil
+	}
+	return restoreFiles(getFileMover(s.dryRun), s.moved)
+}
+
+// dnsRemovalStep removes every registered DNS provider's Deployment that isn't the one
+// cfg now selects, as long as that provider opted in to being replaced, once the newly
+// selected one is up and ready. Providers that don't opt in are left alone, so upgrades
+// never silently delete a DNS Deployment kubeadm doesn't understand. Each removed
+// Deployment is remembered so it can be recreated on rollback.
+type dnsRemovalStep struct {
+	cfg    *kubeadmapi.MasterConfiguration
+	client clientset.Interface
+	dryRun bool
+
+	deleted map[string]*appsv1.Deployment
+}
+
+func (s *dnsRemovalStep) Name() string { return "remove-old-dns-deployment" }
+
+func (s *dnsRemovalStep) Apply() error {
+	return apiclient.TryRunCommand(func() error {
+		current, err := currentDNSProvider(s.cfg)
+		if err != nil {
+			return err
+		}
+		ready, err := current.Detect(s.client)
+		if err != nil {
+			return err
+		}
+		if !ready && !s.dryRun {
+			return fmt.Errorf("the DNS deployment isn't ready yet")
+		}
+
+		for name, provider := range dnsProviders {
+			if name == current.Name() {
+				continue
+			}
+			replaceable, ok := provider.(replaceableDNSProvider)
+			if !ok || !replaceable.ReplaceableByAnother() {
+				continue
+			}
+			present, err := provider.Detect(s.client)
+			if err != nil {
+				return err
+			}
+			if !present {
+				continue
+			}
+
+			if s.dryRun {
+				// Print the DELETE kubeadm would have sent instead of skipping it
+				// outright, the same "[dryrun] Would ..." idiom dryRunFileMover uses for
+				// the other mutating calls this package makes.
+				fmt.Printf("[dryrun] Would delete Deployment %q in namespace %q\n", name, metav1.NamespaceSystem)
+				continue
+			}
+
+			outgoing, err := s.client.AppsV1().Deployments(metav1.NamespaceSystem).Get(name, metav1.GetOptions{})
+			if err != nil {
+				if apierrors.IsNotFound(err) {
+					continue
+				}
+				return err
+			}
+			if s.deleted == nil {
+				s.deleted = map[string]*appsv1.Deployment{}
+			}
+			s.deleted[name] = outgoing.DeepCopy()
+
+			if err := provider.Remove(s.client); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, 10)
+}
+
+func (s *dnsRemovalStep) Rollback() error {
+	errs := []error{}
+	for name, deployment := range s.deleted {
+		restore := deployment.DeepCopy()
+		restore.ResourceVersion = ""
+		if _, err := s.client.AppsV1().Deployments(metav1.NamespaceSystem).Create(restore); err != nil {
+			errs = append(errs, fmt.Errorf("couldn't restore Deployment %s: %v", name, err))
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%v", errs)
+}
+
+// readManifestDir reads every file directly under dir into memory, keyed by file name.
+func readManifestDir(dir string) (map[string][]byte, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list manifests in %s: %v", dir, err)
+	}
+	files := map[string][]byte{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read manifest %s: %v", path, err)
+		}
+		files[entry.Name()] = content
+	}
+	return files, nil
+}
+
+// writeManifestDir writes files back into dir, restoring them to the state readManifestDir
+// captured them in.
+func writeManifestDir(dir string, files map[string][]byte) error {
+	errs := []error{}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("couldn't restore manifests in %s: %v", dir, errs)
+}
@@ -0,0 +1,213 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package upgrade
+
+import (
+	"fmt"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+	kubeadmconstants "k8s.io/kubernetes/cmd/kubeadm/app/constants"
+)
+
+// fakeStep is a postUpgradeStep whose Apply/Rollback behavior is scripted by a test, used
+// to exercise stepExecutor's ordering and abort semantics without depending on any of the
+// real steps' external side effects.
+type fakeStep struct {
+	name       string
+	applyErr   error
+	rolledBack *[]string
+}
+
+func (s *fakeStep) Name() string { return s.name }
+func (s *fakeStep) Apply() error { return s.applyErr }
+func (s *fakeStep) Rollback() error {
+	*s.rolledBack = append(*s.rolledBack, s.name)
+	return nil
+}
+
+// TestStepExecutorUnwind proves that a failing step rolls back every step applied so far,
+// most-recently-applied first, and never rolls back the failing step itself or any step
+// that never got to run.
+func TestStepExecutorUnwind(t *testing.T) {
+	var rolledBack []string
+	executor := &stepExecutor{rollbackOnError: true}
+
+	if err := executor.run(&fakeStep{name: "first", rolledBack: &rolledBack}); err != nil {
+		t.Fatalf("run(first) error = %v", err)
+	}
+	if err := executor.run(&fakeStep{name: "second", rolledBack: &rolledBack}); err != nil {
+		t.Fatalf("run(second) error = %v", err)
+	}
+	err := executor.run(&fakeStep{name: "third", applyErr: fmt.Errorf("boom"), rolledBack: &rolledBack})
+	if err == nil {
+		t.Fatal("run(third) error = nil, want an error")
+	}
+	if !executor.aborted {
+		t.Error("expected executor.aborted to be true after a failed step")
+	}
+
+	want := []string{"second", "first"}
+	if len(rolledBack) != len(want) {
+		t.Fatalf("rolled back %v, want %v", rolledBack, want)
+	}
+	for i, name := range want {
+		if rolledBack[i] != name {
+			t.Errorf("rolled back[%d] = %q, want %q", i, rolledBack[i], name)
+		}
+	}
+}
+
+// TestStepExecutorNoRollbackOnError proves that with rollbackOnError false, a failing step
+// doesn't trigger unwind at all, matching the best-effort behavior
+// PerformPostUpgradeTasksWithRollbackPolicy's noRollback opt-out relies on.
+func TestStepExecutorNoRollbackOnError(t *testing.T) {
+	var rolledBack []string
+	executor := &stepExecutor{rollbackOnError: false}
+
+	if err := executor.run(&fakeStep{name: "first", rolledBack: &rolledBack}); err != nil {
+		t.Fatalf("run(first) error = %v", err)
+	}
+	if err := executor.run(&fakeStep{name: "second", applyErr: fmt.Errorf("boom"), rolledBack: &rolledBack}); err == nil {
+		t.Fatal("run(second) error = nil, want an error")
+	}
+	if executor.aborted {
+		t.Error("expected executor.aborted to stay false when rollbackOnError is false")
+	}
+	if len(rolledBack) != 0 {
+		t.Errorf("expected no rollback, got %v", rolledBack)
+	}
+}
+
+// withStaleUpdateConflict makes client reject an Update on namespace/resource unless the
+// object's ResourceVersion matches the one currently in the tracker, the same optimistic
+// concurrency check a real API server performs but the fake clientset doesn't by itself.
+// This lets a test prove that code re-Gets the current ResourceVersion before retrying,
+// rather than succeeding by accident against a fake that never rejects a stale Update.
+func withStaleUpdateConflict(client *fakeclientset.Clientset, resource string) {
+	client.PrependReactor("update", resource, func(action clienttesting.Action) (bool, runtime.Object, error) {
+		update := action.(clienttesting.UpdateAction).GetObject().(metav1.Object)
+		current, err := client.Tracker().Get(action.GetResource(), action.GetNamespace(), update.GetName())
+		if err != nil {
+			// Nothing to conflict with yet; let the default reactor chain handle it.
+			return false, nil, nil
+		}
+		if update.GetResourceVersion() != current.(metav1.Object).GetResourceVersion() {
+			return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: resource}, update.GetName(), fmt.Errorf("stale ResourceVersion"))
+		}
+		return false, nil, nil
+	})
+}
+
+// TestRestoreConfigMap proves that restoring a ConfigMap succeeds even though prior's own
+// ResourceVersion is stale, by re-Getting the current one immediately before the Update;
+// naively reusing prior's ResourceVersion, as a pre-fix Rollback did, would conflict every
+// time against a server that enforces optimistic concurrency.
+func TestRestoreConfigMap(t *testing.T) {
+	t.Run("restores prior content despite a stale ResourceVersion", func(t *testing.T) {
+		client := fakeclientset.NewSimpleClientset(&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "cm",
+				Namespace:       metav1.NamespaceSystem,
+				ResourceVersion: "2",
+			},
+			Data: map[string]string{"k": "written-by-apply"},
+		})
+		withStaleUpdateConflict(client, "configmaps")
+
+		prior := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "cm",
+				Namespace:       metav1.NamespaceSystem,
+				ResourceVersion: "1",
+			},
+			Data: map[string]string{"k": "original"},
+		}
+
+		if err := restoreConfigMap(client, "cm", prior); err != nil {
+			t.Fatalf("restoreConfigMap() error = %v", err)
+		}
+
+		got, err := client.CoreV1().ConfigMaps(metav1.NamespaceSystem).Get("cm", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		if got.Data["k"] != "original" {
+			t.Errorf("Data[\"k\"] = %q, want %q", got.Data["k"], "original")
+		}
+	})
+
+	t.Run("deletes the ConfigMap when prior is nil", func(t *testing.T) {
+		client := fakeclientset.NewSimpleClientset(&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "cm", Namespace: metav1.NamespaceSystem},
+		})
+
+		if err := restoreConfigMap(client, "cm", nil); err != nil {
+			t.Fatalf("restoreConfigMap() error = %v", err)
+		}
+
+		_, err := client.CoreV1().ConfigMaps(metav1.NamespaceSystem).Get("cm", metav1.GetOptions{})
+		if !apierrors.IsNotFound(err) {
+			t.Errorf("expected the ConfigMap to be gone, Get() error = %v", err)
+		}
+	})
+
+	t.Run("tolerates the ConfigMap already being gone when prior is nil", func(t *testing.T) {
+		client := fakeclientset.NewSimpleClientset()
+		if err := restoreConfigMap(client, "cm", nil); err != nil {
+			t.Errorf("restoreConfigMap() error = %v, want nil", err)
+		}
+	})
+}
+
+// TestDeleteSelfHostedDaemonSets proves that rolling back a self-hosted conversion deletes
+// the self-hosted DaemonSet for every converted static Pod manifest, and tolerates a
+// manifest (like a local etcd's) that never got a self-hosted DaemonSet in the first place.
+func TestDeleteSelfHostedDaemonSets(t *testing.T) {
+	apiserverName := kubeadmconstants.AddSelfHostedPrefix(kubeadmconstants.KubeAPIServer)
+	schedulerName := kubeadmconstants.AddSelfHostedPrefix(kubeadmconstants.KubeScheduler)
+
+	client := fakeclientset.NewSimpleClientset(
+		&appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Name: apiserverName, Namespace: metav1.NamespaceSystem}},
+		&appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Name: schedulerName, Namespace: metav1.NamespaceSystem}},
+	)
+
+	staticPodFiles := map[string][]byte{
+		kubeadmconstants.KubeAPIServer + ".yaml": nil,
+		kubeadmconstants.KubeScheduler + ".yaml": nil,
+		// etcd never runs self-hosted; its manifest has no matching DaemonSet to delete.
+		"etcd.yaml": nil,
+	}
+
+	if err := deleteSelfHostedDaemonSets(client, staticPodFiles); err != nil {
+		t.Fatalf("deleteSelfHostedDaemonSets() error = %v", err)
+	}
+
+	daemonSets := client.AppsV1().DaemonSets(metav1.NamespaceSystem)
+	for _, name := range []string{apiserverName, schedulerName} {
+		if _, err := daemonSets.Get(name, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+			t.Errorf("expected DaemonSet %s to be deleted, Get() error = %v", name, err)
+		}
+	}
+}